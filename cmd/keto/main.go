@@ -0,0 +1,22 @@
+// Command keto is the entry point for the keto service. It starts the
+// Instana sensor so the process reports its fsm lifecycle (init,
+// discovery, announce, ready) to the local Instana agent for the
+// lifetime of the process.
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	instana "github.com/instana/go-sensor"
+)
+
+func main() {
+	sensor := instana.NewSensor(instana.Options{})
+	defer sensor.Shutdown()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+}
@@ -0,0 +1,238 @@
+// (c) Copyright IBM Corp. 2021
+// (c) Copyright Instana Inc. 2016
+
+package instana
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	agentHeader       = "Instana Agent"
+	agentDiscoveryURL = "/com.instana.plugin.golang.discovery"
+	agentDataURL      = "/com.instana.plugin.golang.%d"
+)
+
+// LeveledLogger is the minimal logging surface agentS and fsmS rely on.
+type LeveledLogger interface {
+	Debug(v ...interface{})
+	Info(v ...interface{})
+	Warn(v ...interface{})
+	Error(v ...interface{})
+}
+
+type defaultLogger struct{ *log.Logger }
+
+func newDefaultLogger() *defaultLogger {
+	return &defaultLogger{log.New(os.Stderr, "instana: ", log.LstdFlags)}
+}
+
+func (l *defaultLogger) Debug(v ...interface{}) { l.Println(append([]interface{}{"DEBUG"}, v...)...) }
+func (l *defaultLogger) Info(v ...interface{})  { l.Println(append([]interface{}{"INFO"}, v...)...) }
+func (l *defaultLogger) Warn(v ...interface{})  { l.Println(append([]interface{}{"WARN"}, v...)...) }
+func (l *defaultLogger) Error(v ...interface{}) { l.Println(append([]interface{}{"ERROR"}, v...)...) }
+
+// agentResponse is the payload the host agent returns from a successful
+// announce call.
+type agentResponse struct {
+	Pid int `json:"pid"`
+}
+
+// discoveryS describes the instrumented process to the host agent.
+type discoveryS struct {
+	PID   int
+	Name  string
+	Args  []string
+	Fd    string
+	Inode string
+}
+
+// Options configures a Sensor. Only the fields fsm.go depends on for the
+// retry/discovery/lifecycle work are declared here.
+type Options struct {
+	// RetryPolicy overrides the default exponential backoff used while
+	// waiting for the host agent. Nil uses DefaultRetryPolicy().
+	RetryPolicy *RetryPolicy
+	// HostLocators are consulted, in order, before the built-in
+	// localhost/default-gateway lookup.
+	HostLocators []HostLocator
+}
+
+type agentS struct {
+	host    string
+	logger  LeveledLogger
+	Options Options
+	ctx     context.Context
+
+	httpClient *http.Client
+	fsm        *fsmS
+}
+
+func (a *agentS) makeHostURL(host, path string) string {
+	return fmt.Sprintf("http://%s:42699%s", host, path)
+}
+
+func (a *agentS) makeURL(path string) string {
+	return a.makeHostURL(a.host, path)
+}
+
+func (a *agentS) setHost(host string) {
+	a.host = host
+}
+
+func (a *agentS) applyHostAgentSettings(resp agentResponse) {
+	// No per-announce settings beyond the pid are honored yet.
+}
+
+func (a *agentS) requestHeader(ctx context.Context, url, method, header string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	return resp.Header.Get(header), nil
+}
+
+func (a *agentS) requestResponse(ctx context.Context, url, method string, body, out interface{}) (int, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, &buf)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+
+	return resp.StatusCode, nil
+}
+
+func (a *agentS) head(ctx context.Context, url string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+// getDefaultGateway parses the kernel routing table exposed at path (on
+// Linux, /proc/net/route) for the default route's gateway address.
+func getDefaultGateway(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header line
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		return parseHexGatewayIP(fields[2])
+	}
+
+	return "", scanner.Err()
+}
+
+func parseHexGatewayIP(hex string) (string, error) {
+	var b [4]byte
+	if _, err := fmt.Sscanf(hex, "%02x%02x%02x%02x", &b[3], &b[2], &b[1], &b[0]); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d.%d.%d.%d", b[0], b[1], b[2], b[3]), nil
+}
+
+// getProcCommandLine reads the original process name/args from
+// /proc/self/cmdline, reporting false when /proc isn't available.
+func getProcCommandLine() (string, []string, bool) {
+	data, err := os.ReadFile("/proc/self/cmdline")
+	if err != nil {
+		return "", nil, false
+	}
+
+	parts := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+	if len(parts) == 0 || parts[0] == "" {
+		return "", nil, false
+	}
+
+	return parts[0], parts[1:], true
+}
+
+// Sensor is the entry point applications embed to instrument their
+// process. It owns the agentS/fsmS pair that negotiates with the host
+// agent and exposes the lifecycle hooks external callers need.
+type Sensor struct {
+	agent *agentS
+}
+
+// NewSensor starts a Sensor's fsm against the host agent using opts.
+func NewSensor(opts Options) *Sensor {
+	agent := &agentS{
+		host:       "localhost",
+		logger:     newDefaultLogger(),
+		Options:    opts,
+		ctx:        context.Background(),
+		httpClient: &http.Client{},
+	}
+	agent.fsm = newFSM(agent)
+
+	return &Sensor{agent: agent}
+}
+
+// Ready reports whether the sensor has completed its handshake with the
+// host agent and is ready to submit data.
+func (s *Sensor) Ready() bool { return s.agent.Ready() }
+
+// StateChanged forwards the underlying fsm's state transitions; see
+// (*agentS).StateChanged.
+func (s *Sensor) StateChanged() <-chan string { return s.agent.StateChanged() }
+
+// StateValue reports the instana_agent_fsm_state gauge value for this
+// sensor's fsm, for callers wiring it into their own metrics registry.
+func (s *Sensor) StateValue() float64 { return s.agent.fsm.StateValue() }
+
+// Shutdown stops the sensor's fsm: its context is cancelled, any pending
+// retry timer is stopped and outstanding callbacks are waited out.
+func (s *Sensor) Shutdown() { s.agent.fsm.Shutdown() }
@@ -0,0 +1,53 @@
+// (c) Copyright IBM Corp. 2021
+// (c) Copyright Instana Inc. 2016
+
+package instana
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	f "github.com/looplab/fsm"
+)
+
+func TestShutdownDrainsOutstandingRetry(t *testing.T) {
+	agent := &agentS{host: "127.0.0.1", logger: newDefaultLogger(), ctx: context.Background()}
+	ctx, cancel := context.WithCancel(agent.ctx)
+
+	r := &fsmS{
+		agent:       agent,
+		retryPolicy: &RetryPolicy{InitialDelay: time.Hour, Multiplier: 2, MaxDelay: time.Hour},
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	r.scheduleRetry(nil, func(e *f.Event) {
+		t.Error("retry callback fired even though Shutdown cancelled the context first")
+	})
+
+	done := make(chan struct{})
+	go func() {
+		r.Shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return promptly after cancelling an hour-long pending retry")
+	}
+}
+
+func TestSensorForwardsFSMLifecycle(t *testing.T) {
+	s := NewSensor(Options{})
+	defer s.Shutdown()
+
+	if s.Ready() {
+		t.Fatal("a freshly created sensor should not report Ready before announcing")
+	}
+
+	if s.StateChanged() == nil {
+		t.Fatal("StateChanged should return a usable channel")
+	}
+}
@@ -0,0 +1,183 @@
+// (c) Copyright IBM Corp. 2021
+// (c) Copyright Instana Inc. 2016
+
+package instana
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnvLocator(t *testing.T) {
+	t.Run("host and port set", func(t *testing.T) {
+		t.Setenv("INSTANA_AGENT_HOST", "agent.example.com")
+		t.Setenv("INSTANA_AGENT_PORT", "1234")
+
+		hosts, err := envLocator{}.Locate(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(hosts) != 1 || hosts[0] != "agent.example.com:1234" {
+			t.Fatalf("expected [agent.example.com:1234], got %v", hosts)
+		}
+	})
+
+	t.Run("host only", func(t *testing.T) {
+		t.Setenv("INSTANA_AGENT_HOST", "agent.example.com")
+		t.Setenv("INSTANA_AGENT_PORT", "")
+
+		hosts, err := envLocator{}.Locate(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(hosts) != 1 || hosts[0] != "agent.example.com" {
+			t.Fatalf("expected [agent.example.com], got %v", hosts)
+		}
+	})
+
+	t.Run("unset", func(t *testing.T) {
+		t.Setenv("INSTANA_AGENT_HOST", "")
+		t.Setenv("INSTANA_AGENT_PORT", "")
+
+		hosts, err := envLocator{}.Locate(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if hosts != nil {
+			t.Fatalf("expected no candidates, got %v", hosts)
+		}
+	})
+}
+
+func TestKubernetesLocator(t *testing.T) {
+	t.Run("downward API file wins over environment", func(t *testing.T) {
+		t.Setenv("HOST_IP", "10.0.0.1")
+		t.Setenv("NODE_NAME", "node-1")
+
+		path := filepath.Join(t.TempDir(), "hostip")
+		if err := os.WriteFile(path, []byte("10.0.0.2\n"), 0o644); err != nil {
+			t.Fatalf("failed to write downward API file: %v", err)
+		}
+
+		l := &kubernetesLocator{DownwardAPIFile: path}
+		hosts, err := l.Locate(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(hosts) != 1 || hosts[0] != "10.0.0.2" {
+			t.Fatalf("expected [10.0.0.2], got %v", hosts)
+		}
+	})
+
+	t.Run("falls back to HOST_IP when no file is configured", func(t *testing.T) {
+		t.Setenv("HOST_IP", "10.0.0.1")
+		t.Setenv("NODE_NAME", "node-1")
+
+		l := &kubernetesLocator{}
+		hosts, err := l.Locate(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(hosts) != 1 || hosts[0] != "10.0.0.1" {
+			t.Fatalf("expected [10.0.0.1], got %v", hosts)
+		}
+	})
+
+	t.Run("falls back to NODE_NAME when HOST_IP is unset", func(t *testing.T) {
+		t.Setenv("HOST_IP", "")
+		t.Setenv("NODE_NAME", "node-1")
+
+		l := &kubernetesLocator{}
+		hosts, err := l.Locate(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(hosts) != 1 || hosts[0] != "node-1" {
+			t.Fatalf("expected [node-1], got %v", hosts)
+		}
+	})
+
+	t.Run("downward API file read failure is reported", func(t *testing.T) {
+		l := &kubernetesLocator{DownwardAPIFile: filepath.Join(t.TempDir(), "missing")}
+		if _, err := l.Locate(context.Background()); err == nil {
+			t.Fatal("expected an error when the downward API file cannot be read")
+		}
+	})
+
+	t.Run("nothing configured", func(t *testing.T) {
+		t.Setenv("HOST_IP", "")
+		t.Setenv("NODE_NAME", "")
+
+		l := &kubernetesLocator{}
+		hosts, err := l.Locate(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if hosts != nil {
+			t.Fatalf("expected no candidates, got %v", hosts)
+		}
+	})
+}
+
+func TestDNSSRVLocatorResolutionError(t *testing.T) {
+	l := &dnsSRVLocator{Service: "instana-agent", Proto: "tcp", Name: "invalid.invalid."}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := l.Locate(ctx); err == nil {
+		t.Fatal("expected an error when SRV resolution fails")
+	}
+}
+
+// stubLocator is a HostLocator whose behavior and call tracking are fixed
+// at construction, so tryLocators' order-then-fallback walk can be
+// asserted without touching the network.
+type stubLocator struct {
+	name  string
+	hosts []string
+	err   error
+	calls *[]string
+}
+
+func (s *stubLocator) Locate(ctx context.Context) ([]string, error) {
+	if s.calls != nil {
+		*s.calls = append(*s.calls, s.name)
+	}
+	return s.hosts, s.err
+}
+
+func TestTryLocatorsWalksEveryLocatorInOrderBeforeRetrying(t *testing.T) {
+	agent := &agentS{host: "127.0.0.1", logger: newDefaultLogger()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fsmS{
+		agent:        agent,
+		retryPolicy:  &RetryPolicy{InitialDelay: time.Millisecond, Multiplier: 2, MaxDelay: time.Millisecond},
+		ctx:          ctx,
+		cancel:       cancel,
+		stateChanged: make(chan string, 1),
+	}
+
+	var calls []string
+	locators := []HostLocator{
+		&stubLocator{name: "first", err: errors.New("locator unavailable"), calls: &calls},
+		&stubLocator{name: "second", hosts: nil, calls: &calls},
+		&stubLocator{name: "third", hosts: nil, calls: &calls},
+	}
+
+	r.tryLocators(nil, locators)
+
+	if len(calls) != 3 || calls[0] != "first" || calls[1] != "second" || calls[2] != "third" {
+		t.Fatalf("expected every locator to be consulted in order, got %v", calls)
+	}
+	if r.timer == nil {
+		t.Fatal("expected a retry to be scheduled once every locator comes up empty")
+	}
+}
@@ -0,0 +1,83 @@
+// (c) Copyright IBM Corp. 2021
+// (c) Copyright Instana Inc. 2016
+
+package instana
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyNextRespectsMaxDelay(t *testing.T) {
+	p := &RetryPolicy{
+		InitialDelay: 10 * time.Millisecond,
+		Multiplier:   2,
+		MaxDelay:     20 * time.Millisecond,
+		Jitter:       0.5,
+	}
+
+	for i := 0; i < 10; i++ {
+		d := p.next()
+		if d > p.MaxDelay {
+			t.Fatalf("attempt %d: delay %s exceeds MaxDelay %s", i, d, p.MaxDelay)
+		}
+		if d < 0 {
+			t.Fatalf("attempt %d: delay %s is negative", i, d)
+		}
+	}
+}
+
+func TestRetryPolicyNextGrowsByMultiplier(t *testing.T) {
+	p := &RetryPolicy{InitialDelay: 10 * time.Millisecond, Multiplier: 2, MaxDelay: time.Second}
+
+	p.next()
+	if p.delay != 20*time.Millisecond {
+		t.Fatalf("expected delay to double to 20ms, got %s", p.delay)
+	}
+}
+
+func TestRetryPolicyReset(t *testing.T) {
+	p := &RetryPolicy{InitialDelay: 10 * time.Millisecond, Multiplier: 2, MaxDelay: time.Second}
+
+	p.next()
+	p.next()
+	p.reset()
+
+	if p.delay != 0 {
+		t.Fatalf("reset did not clear delay, got %s", p.delay)
+	}
+}
+
+func TestLookupAgentHostGivesUpAfterMaxElapsed(t *testing.T) {
+	agent := &agentS{host: "127.0.0.1", logger: newDefaultLogger(), ctx: context.Background(), httpClient: &http.Client{}}
+
+	// Reset below starts a real host lookup; cancel it when the test ends.
+	ctx, cancel := context.WithCancel(agent.ctx)
+	defer cancel()
+
+	r := &fsmS{
+		agent:        agent,
+		retryPolicy:  &RetryPolicy{InitialDelay: time.Millisecond, Multiplier: 2, MaxDelay: 10 * time.Millisecond, MaxElapsed: 5 * time.Millisecond},
+		ctx:          ctx,
+		cancel:       cancel,
+		stateChanged: make(chan string, 1),
+		locators:     []HostLocator{&defaultLocator{host: agent.host, logger: agent.logger}},
+	}
+
+	wireFSM(r)
+
+	r.lookupStart = time.Now().Add(-time.Second)
+	r.lookupAgentHost(nil)
+
+	if r.timer != nil {
+		t.Fatal("expected no retry to be scheduled once MaxElapsed is exceeded")
+	}
+
+	r.retries = 0
+	r.Reset()
+	if r.retries != maximumRetries {
+		t.Fatal("Reset did not restore retries to maximumRetries")
+	}
+}
@@ -5,11 +5,16 @@ package instana
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"math/rand"
 	"net"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	f "github.com/looplab/fsm"
@@ -21,15 +26,243 @@ const (
 	eAnnounce = "announce"
 	eTest     = "test"
 
-	retryPeriod    = 30 * 1000 * time.Millisecond
 	maximumRetries = 2
+
+	defaultRetryInitialDelay = 500 * time.Millisecond
+	defaultRetryMultiplier   = 2.0
+	defaultRetryMaxDelay     = 60 * time.Second
+	defaultRetryJitter       = 0.2
+	defaultRetryMaxElapsed   = 5 * time.Minute
 )
 
+// Gauge values for instana_agent_fsm_state, in fsm state order.
+const (
+	fsmStateNone = iota
+	fsmStateInit
+	fsmStateUnannounced
+	fsmStateAnnounced
+	fsmStateReady
+)
+
+func fsmStateValue(state string) int32 {
+	switch state {
+	case "init":
+		return fsmStateInit
+	case "unannounced":
+		return fsmStateUnannounced
+	case "announced":
+		return fsmStateAnnounced
+	case "ready":
+		return fsmStateReady
+	default:
+		return fsmStateNone
+	}
+}
+
+// RetryPolicy controls the exponential backoff fsmS uses between retry
+// attempts while it waits for the host agent to become reachable or to
+// accept an announcement. A zero value is not ready to use, call
+// DefaultRetryPolicy() instead.
+type RetryPolicy struct {
+	// InitialDelay is the delay before the first retry attempt.
+	InitialDelay time.Duration
+	// Multiplier is applied to the delay after every attempt.
+	Multiplier float64
+	// MaxDelay caps the delay actually waited, no matter how many
+	// attempts were made or how jitter nudges it.
+	MaxDelay time.Duration
+	// Jitter is the fraction (0..1) of the computed delay that is randomly
+	// added or subtracted, so co-located processes restarting together
+	// don't reconnect to the agent in lockstep.
+	Jitter float64
+	// MaxElapsed bounds how long lookupAgentHost keeps retrying before it
+	// gives up and waits for an external Reset(). Zero means no bound.
+	MaxElapsed time.Duration
+
+	delay time.Duration
+}
+
+// DefaultRetryPolicy returns the RetryPolicy used when Options.RetryPolicy
+// is left unset: a 500ms initial delay doubling up to a 60s cap, ±20%
+// jitter and a 5 minute bound on the agent host lookup.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		InitialDelay: defaultRetryInitialDelay,
+		Multiplier:   defaultRetryMultiplier,
+		MaxDelay:     defaultRetryMaxDelay,
+		Jitter:       defaultRetryJitter,
+		MaxElapsed:   defaultRetryMaxElapsed,
+	}
+}
+
+// next returns the delay to wait before the next retry and advances the
+// policy to the following one. The returned delay never exceeds MaxDelay,
+// even after jitter is applied.
+func (p *RetryPolicy) next() time.Duration {
+	if p.delay == 0 {
+		p.delay = p.InitialDelay
+	}
+
+	d := p.delay
+
+	if p.Jitter > 0 {
+		delta := float64(d) * p.Jitter
+		d += time.Duration(delta*2*rand.Float64() - delta)
+		if d < 0 {
+			d = 0
+		}
+	}
+
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+
+	p.delay = time.Duration(float64(p.delay) * p.Multiplier)
+	if p.MaxDelay > 0 && p.delay > p.MaxDelay {
+		p.delay = p.MaxDelay
+	}
+
+	return d
+}
+
+// reset restores the policy to its initial delay, e.g. once the FSM
+// reaches the ready state.
+func (p *RetryPolicy) reset() {
+	p.delay = 0
+}
+
+// HostLocator discovers candidate agent host addresses. newFSM consults
+// each registered locator in order, probing every candidate it returns
+// with checkHost, until one of them responds.
+type HostLocator interface {
+	Locate(ctx context.Context) ([]string, error)
+}
+
+// defaultLocator reproduces the historical lookup strategy: the
+// configured agent host, falling back to the default gateway reported by
+// /proc/net/route. It is always appended after any user-supplied
+// locators so existing deployments keep working unmodified.
+type defaultLocator struct {
+	host   string
+	logger LeveledLogger
+}
+
+func (l *defaultLocator) Locate(ctx context.Context) ([]string, error) {
+	candidates := []string{l.host}
+
+	gateway, err := getDefaultGateway("/proc/net/route")
+	if err != nil {
+		l.logger.Error("failed to fetch the default gateway: ", err)
+		return candidates, nil
+	}
+
+	if gateway == "" {
+		l.logger.Error("default gateway not available")
+		return candidates, nil
+	}
+
+	return append(candidates, gateway), nil
+}
+
+// envLocator reads the agent address from INSTANA_AGENT_HOST (and,
+// optionally, INSTANA_AGENT_PORT), for setups that inject the agent
+// address through the environment rather than exposing it on the
+// default gateway.
+type envLocator struct{}
+
+func (envLocator) Locate(ctx context.Context) ([]string, error) {
+	host := os.Getenv("INSTANA_AGENT_HOST")
+	if host == "" {
+		return nil, nil
+	}
+
+	if port := os.Getenv("INSTANA_AGENT_PORT"); port != "" {
+		host = host + ":" + port
+	}
+
+	return []string{host}, nil
+}
+
+// kubernetesLocator discovers the node's agent address when running as a
+// DaemonSet, where the agent is reachable at the node IP exposed through
+// the Kubernetes downward API.
+type kubernetesLocator struct {
+	// DownwardAPIFile is a file mounted via the downward API containing
+	// the node IP, e.g. status.hostIP. Its whole content, trimmed of
+	// surrounding whitespace, is used as a single host. Leave empty
+	// to fall back to the HOST_IP/NODE_NAME environment variables.
+	DownwardAPIFile string
+}
+
+func (l *kubernetesLocator) Locate(ctx context.Context) ([]string, error) {
+	if l.DownwardAPIFile != "" {
+		data, err := os.ReadFile(l.DownwardAPIFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read downward API file %s: %w", l.DownwardAPIFile, err)
+		}
+
+		if host := strings.TrimSpace(string(data)); host != "" {
+			return []string{host}, nil
+		}
+	}
+
+	if host := os.Getenv("HOST_IP"); host != "" {
+		return []string{host}, nil
+	}
+
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		return []string{node}, nil
+	}
+
+	return nil, nil
+}
+
+// dnsSRVLocator resolves a user-supplied DNS SRV record, e.g. one
+// published by a headless Kubernetes Service in front of the agent
+// DaemonSet.
+type dnsSRVLocator struct {
+	Service string
+	Proto   string
+	Name    string
+}
+
+func (l *dnsSRVLocator) Locate(ctx context.Context) ([]string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, l.Service, l.Proto, l.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve SRV record for %s: %w", l.Name, err)
+	}
+
+	hosts := make([]string, 0, len(records))
+	for _, rec := range records {
+		hosts = append(hosts, strings.TrimSuffix(rec.Target, "."))
+	}
+
+	return hosts, nil
+}
+
 type fsmS struct {
-	agent   *agentS
-	fsm     *f.FSM
-	timer   *time.Timer
-	retries int
+	agent       *agentS
+	fsm         *f.FSM
+	timer       *time.Timer
+	retries     int
+	retryPolicy *RetryPolicy
+	lookupStart time.Time
+	locators    []HostLocator
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	stateChanged chan string
+	stateGauge   int32
+}
+
+// AddHostLocator registers an additional HostLocator that newFSM will
+// consult, in registration order, before falling back to the built-in
+// localhost/default-gateway lookup. newFSM copies the registered locators
+// once; a locator added after the fsm is built is not consulted.
+func (a *agentS) AddHostLocator(loc HostLocator) {
+	a.Options.HostLocators = append(a.Options.HostLocators, loc)
 }
 
 var procSchedPIDRegex = regexp.MustCompile(`\((\d+),`)
@@ -38,11 +271,42 @@ func newFSM(agent *agentS) *fsmS {
 	agent.logger.Warn("Stan is on the scene. Starting Instana instrumentation.")
 	agent.logger.Debug("initializing fsm")
 
+	retryPolicy := agent.Options.RetryPolicy
+	if retryPolicy == nil {
+		retryPolicy = DefaultRetryPolicy()
+	}
+
+	locators := append([]HostLocator{}, agent.Options.HostLocators...)
+	locators = append(locators, &defaultLocator{host: agent.host, logger: agent.logger})
+
+	parent := agent.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+
 	ret := &fsmS{
-		agent:   agent,
-		retries: maximumRetries,
+		agent:        agent,
+		retries:      maximumRetries,
+		retryPolicy:  retryPolicy,
+		locators:     locators,
+		ctx:          ctx,
+		cancel:       cancel,
+		stateChanged: make(chan string, 1),
 	}
 
+	wireFSM(ret)
+	ret.fsm.Event(eInit)
+
+	return ret
+}
+
+// wireFSM builds the looplab/fsm state machine for ret and assigns it to
+// ret.fsm, binding the transition callbacks to ret's methods. It does not
+// fire any event, so callers (tests, in particular) can populate the rest
+// of a *fsmS by hand and still get a working ret.fsm without the "init"
+// callback immediately kicking off a real host lookup.
+func wireFSM(ret *fsmS) {
 	ret.fsm = f.NewFSM(
 		"none",
 		f.Events{
@@ -54,61 +318,154 @@ func newFSM(agent *agentS) *fsmS {
 			"init":              ret.lookupAgentHost,
 			"enter_unannounced": ret.announceSensor,
 			"enter_announced":   ret.testAgent,
+			"enter_ready":       ret.enterReady,
+			"enter_state":       ret.observeState,
 		})
-	ret.fsm.Event(eInit)
+}
 
-	return ret
+// Ready reports whether the sensor has completed its handshake with the
+// host agent and is ready to submit data.
+func (a *agentS) Ready() bool {
+	return a.fsm.fsm.Current() == "ready"
+}
+
+// StateChanged returns a channel that receives the fsm's state name
+// (init, unannounced, announced, ready) after every transition, so
+// callers can gate their own initialization on agent readiness instead
+// of polling Ready(). The channel is buffered with size 1; a consumer
+// that falls behind misses intermediate states but the latest one is
+// always delivered.
+func (a *agentS) StateChanged() <-chan string {
+	return a.fsm.stateChanged
+}
+
+// observeState updates this fsm's instana_agent_fsm_state gauge and
+// notifies StateChanged on every transition.
+func (r *fsmS) observeState(e *f.Event) {
+	atomic.StoreInt32(&r.stateGauge, fsmStateValue(e.Dst))
+
+	// Drop a state the consumer has not read yet, so the buffer always
+	// holds the latest one.
+	select {
+	case <-r.stateChanged:
+	default:
+	}
+
+	select {
+	case r.stateChanged <- e.Dst:
+	default:
+	}
+}
+
+// StateValue reports this fsm's current instana_agent_fsm_state gauge
+// value (none=0, init=1, unannounced=2, announced=3, ready=4). The value
+// lives on the fsmS instance rather than a package-level variable, so
+// concurrent sensors (e.g. in tests) each track their own state; wire it
+// into a real prometheus.Gauge via a metrics registry if one is needed.
+func (r *fsmS) StateValue() float64 {
+	return float64(atomic.LoadInt32(&r.stateGauge))
+}
+
+func (r *fsmS) enterReady(e *f.Event) {
+	r.retryPolicy.reset()
+}
+
+// Shutdown cancels the fsm's context, stops any pending retry timer and
+// waits for outstanding callbacks (lookupAgentHost, announceSensor,
+// testAgent, checkHost) to return.
+func (r *fsmS) Shutdown() {
+	r.cancel()
+
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+
+	r.wg.Wait()
 }
 
 func (r *fsmS) scheduleRetry(e *f.Event, cb func(e *f.Event)) {
-	r.timer = time.NewTimer(retryPeriod)
+	r.timer = time.NewTimer(r.retryPolicy.next())
+
+	r.wg.Add(1)
 	go func() {
-		<-r.timer.C
-		cb(e)
+		defer r.wg.Done()
+
+		select {
+		case <-r.timer.C:
+			cb(e)
+		case <-r.ctx.Done():
+			r.timer.Stop()
+		}
 	}()
 }
 
 func (r *fsmS) lookupAgentHost(e *f.Event) {
-	cb := func(found bool, host string) {
-		if found {
-			r.lookupSuccess(host)
+	if r.ctx.Err() != nil {
+		return
+	}
+
+	if r.lookupStart.IsZero() {
+		r.lookupStart = time.Now()
+	}
+
+	if mx := r.retryPolicy.MaxElapsed; mx > 0 && time.Since(r.lookupStart) > mx {
+		r.agent.logger.Error("agent host lookup exceeded ", mx, ", giving up until Reset() is called")
+		return
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.tryLocators(e, r.locators)
+	}()
+}
+
+// tryLocators walks the configured HostLocators in order, probing every
+// candidate a locator returns with checkHost before moving on to the
+// next locator.
+func (r *fsmS) tryLocators(e *f.Event, locators []HostLocator) {
+	for _, loc := range locators {
+		if r.ctx.Err() != nil {
 			return
 		}
 
-		gateway, err := getDefaultGateway("/proc/net/route")
+		candidates, err := loc.Locate(r.ctx)
 		if err != nil {
-			r.agent.logger.Error("failed to fetch the default gateway, scheduling retry: ", err)
-			r.scheduleRetry(e, r.lookupAgentHost)
-
-			return
+			r.agent.logger.Debug("host locator failed, trying next one: ", err)
+			continue
 		}
 
-		if gateway == "" {
-			r.agent.logger.Error("default gateway not available, scheduling retry")
-			r.scheduleRetry(e, r.lookupAgentHost)
+		for _, host := range candidates {
+			if r.ctx.Err() != nil {
+				return
+			}
 
-			return
-		}
+			found := false
+			r.checkHost(r.ctx, host, func(ok bool, h string) {
+				found = ok
+				if ok {
+					r.lookupSuccess(h)
+				}
+			})
 
-		go r.checkHost(gateway, func(found bool, host string) {
 			if found {
-				r.lookupSuccess(host)
 				return
 			}
+		}
+	}
 
-			r.agent.logger.Error("cannot connect to the agent through localhost or default gateway, scheduling retry")
-			r.scheduleRetry(e, r.lookupAgentHost)
-		})
-
+	if r.ctx.Err() != nil {
+		return
 	}
 
-	go r.checkHost(r.agent.host, cb)
+	r.agent.logger.Error("cannot connect to the agent through any configured host locator, scheduling retry")
+	r.scheduleRetry(e, r.lookupAgentHost)
 }
 
-func (r *fsmS) checkHost(host string, cb func(found bool, host string)) {
+func (r *fsmS) checkHost(ctx context.Context, host string, cb func(found bool, host string)) {
 	r.agent.logger.Debug("checking host ", host)
 
-	header, err := r.agent.requestHeader(r.agent.makeHostURL(host, "/"), "GET", "Server")
+	header, err := r.agent.requestHeader(ctx, r.agent.makeHostURL(host, "/"), "GET", "Server")
 
 	cb(err == nil && header == agentHeader, host)
 }
@@ -118,6 +475,7 @@ func (r *fsmS) lookupSuccess(host string) {
 
 	r.agent.setHost(host)
 	r.retries = maximumRetries
+	r.lookupStart = time.Time{}
 	r.fsm.Event(eLookup)
 }
 
@@ -145,13 +503,19 @@ func (r *fsmS) announceSensor(e *f.Event) {
 
 	r.agent.logger.Debug("announcing sensor to the agent")
 
+	r.wg.Add(1)
 	go func(cb func(success bool, resp agentResponse)) {
+		defer r.wg.Done()
 		defer func() {
 			if err := recover(); err != nil {
 				r.agent.logger.Debug("Announce recovered:", err)
 			}
 		}()
 
+		if r.ctx.Err() != nil {
+			return
+		}
+
 		pid := 0
 		schedFile := fmt.Sprintf("/proc/%d/sched", os.Getpid())
 		if _, err := os.Stat(schedFile); err == nil {
@@ -187,19 +551,20 @@ func (r *fsmS) announceSensor(e *f.Event) {
 			r.agent.logger.Debug("no /proc, using OS reported cmdline")
 		}
 
-		if _, err := os.Stat("/proc"); err == nil {
-			if addr, err := net.ResolveTCPAddr("tcp", r.agent.host+":42699"); err == nil {
-				if tcpConn, err := net.DialTCP("tcp", nil, addr); err == nil {
-					defer tcpConn.Close()
+		if _, err := os.Stat("/proc"); err == nil && r.ctx.Err() == nil {
+			dialer := &net.Dialer{}
+			if conn, err := dialer.DialContext(r.ctx, "tcp", r.agent.host+":42699"); err == nil {
+				defer conn.Close()
 
-					f, err := tcpConn.File()
+				if tcpConn, ok := conn.(*net.TCPConn); ok {
+					fd, err := tcpConn.File()
 
 					if err != nil {
 						r.agent.logger.Error(err)
 					} else {
-						d.Fd = fmt.Sprintf("%v", f.Fd())
+						d.Fd = fmt.Sprintf("%v", fd.Fd())
 
-						link := fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), f.Fd())
+						link := fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), fd.Fd())
 						if _, err := os.Stat(link); err == nil {
 							d.Inode, _ = os.Readlink(link)
 						}
@@ -209,7 +574,7 @@ func (r *fsmS) announceSensor(e *f.Event) {
 		}
 
 		var resp agentResponse
-		_, err := r.agent.requestResponse(r.agent.makeURL(agentDiscoveryURL), "PUT", d, &resp)
+		_, err := r.agent.requestResponse(r.ctx, r.agent.makeURL(agentDiscoveryURL), "PUT", d, &resp)
 		cb(err == nil, resp)
 	}(cb)
 }
@@ -232,8 +597,15 @@ func (r *fsmS) testAgent(e *f.Event) {
 
 	r.agent.logger.Debug("testing communication with the agent")
 
+	r.wg.Add(1)
 	go func(cb func(b bool)) {
-		_, err := r.agent.head(r.agent.makeURL(agentDataURL))
+		defer r.wg.Done()
+
+		if r.ctx.Err() != nil {
+			return
+		}
+
+		_, err := r.agent.head(r.ctx, r.agent.makeURL(agentDataURL))
 		cb(err == nil)
 	}(cb)
 }
@@ -242,3 +614,20 @@ func (r *fsmS) reset() {
 	r.retries = maximumRetries
 	r.fsm.Event(eInit)
 }
+
+// Reset restarts the FSM from the init state and clears the elapsed time
+// tracked against RetryPolicy.MaxElapsed, letting lookupAgentHost retry
+// again after it gave up.
+func (r *fsmS) Reset() {
+	r.lookupStart = time.Time{}
+
+	// eInit has no init->init transition, so a lookup that gave up while
+	// in init is restarted directly.
+	if r.fsm.Current() == "init" {
+		r.retries = maximumRetries
+		r.lookupAgentHost(nil)
+		return
+	}
+
+	r.reset()
+}